@@ -1,13 +1,18 @@
 package dispatcher
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/swarm-v2/api"
@@ -18,49 +23,335 @@ import (
 
 var defaultTTL = 5 * time.Second
 
+// sendTimeout bounds how long WatchTasks will wait for a single assignment
+// message to be accepted by the gRPC send buffer before giving up on a
+// stalled agent.
+const sendTimeout = 10 * time.Second
+
+// retryAfterMetadataKey is the gRPC trailer key used to surface a rate
+// limiter's backoff hint as structured metadata, so a throttled caller can
+// read it from the call's trailer metadata (grpc.Trailer) and parse it with
+// time.ParseDuration instead of parsing it out of the error string.
+const retryAfterMetadataKey = "retry-after"
+
+// minHeartbeatTTL and maxHeartbeatTTL bound the adaptive TTL computed by
+// computeHeartbeatTTL, regardless of cluster size.
+const (
+	minHeartbeatTTL = 1 * time.Second
+	maxHeartbeatTTL = 30 * time.Second
+)
+
 type registeredNode struct {
 	Heartbeat *heartbeat.Heartbeat
-	Tasks     []string
+	Tasks     map[string]*api.Task
 	Node      *api.Node
+
+	// SessionID identifies the current Session stream for this node. It
+	// changes every time the node establishes (or re-establishes) a
+	// session, so RPCs carrying a stale SessionID can be rejected instead
+	// of racing with a newer connection from the same node.
+	SessionID string
+
+	// done is closed exactly once, when this registeredNode is
+	// deregistered: by nodeDown, by drain, or by being superseded when the
+	// same node ID reconnects through registerNode. nodeDownCh hands out
+	// this same channel to every caller watching the node, so a blocked
+	// Session or WatchTasks goroutine wakes as soon as it happens rather
+	// than on whatever unrelated event next reaches its select. This is
+	// also what tells an in-flight Session stream it has been superseded
+	// by a newer one for the same node ID, rather than a separate
+	// generation counter.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// closeDone wakes any goroutine blocked on this node's done channel. Safe
+// to call more than once (e.g. a heartbeat lapse racing a drain).
+func (rn *registeredNode) closeDone() {
+	rn.doneOnce.Do(func() { close(rn.done) })
+}
+
+// nodeTasks returns the current set of task IDs assigned to the node, used
+// as the basis for diffing against subsequent store events.
+func (rn *registeredNode) nodeTasks() map[string]*api.Task {
+	if rn.Tasks == nil {
+		rn.Tasks = make(map[string]*api.Task)
+	}
+	return rn.Tasks
 }
 
 var (
-	// ErrNodeAlreadyRegistered returned if node with same ID was already
-	// registered with this dispatcher.
-	ErrNodeAlreadyRegistered = errors.New("node already registered")
 	// ErrNodeNotRegistered returned if node with such ID wasn't registered
 	// with this dispatcher.
 	ErrNodeNotRegistered = errors.New("node not registered")
+	// ErrSessionInvalid returned if the session in use by a node is no
+	// longer valid. The node should re-establish a session.
+	ErrSessionInvalid = errors.New("session invalid")
 )
 
+// Config configures a Dispatcher.
+type Config struct {
+	// RateLimitBurst is the number of RegisterNode/Session attempts a
+	// single peer may make in a RateLimitPeriod window before being
+	// throttled with a backoff hint.
+	RateLimitBurst int
+	// RateLimitPeriod is the window over which RateLimitBurst attempts are
+	// replenished.
+	RateLimitPeriod time.Duration
+	// MaxConnectionsPerNode caps the number of concurrent sessions a
+	// single node ID may hold open with this dispatcher.
+	MaxConnectionsPerNode int
+
+	// HeartbeatPeriod is the base heartbeat TTL (before cluster-size
+	// scaling and jitter are applied).
+	HeartbeatPeriod time.Duration
+	// HeartbeatEpsilon bounds the per-node jitter added on top of the
+	// scaled TTL, so agents reconnecting simultaneously after a failover
+	// don't all come due at exactly the same instant.
+	HeartbeatEpsilon time.Duration
+	// GracePeriodMultiplier is the number of registered nodes per 1x
+	// increase in heartbeat TTL: ttl scales as base * (1 +
+	// nodes/GracePeriodMultiplier), clamped to [minHeartbeatTTL,
+	// maxHeartbeatTTL].
+	GracePeriodMultiplier int
+}
+
+// DefaultConfig returns a Config with conservative defaults, suitable when
+// the caller does not need to tune throttling behavior.
+func DefaultConfig() *Config {
+	return &Config{
+		RateLimitBurst:        3,
+		RateLimitPeriod:       time.Second,
+		MaxConnectionsPerNode: 1,
+		HeartbeatPeriod:       defaultTTL,
+		HeartbeatEpsilon:      time.Second,
+		GracePeriodMultiplier: 50,
+	}
+}
+
 // Dispatcher is responsible for dispatching tasks and tracking agent health.
+// It only serves RPCs while running: in a raft-backed manager this should
+// track leadership, since only the leader's view of the store is
+// authoritative.
 type Dispatcher struct {
-	mu    sync.Mutex
-	nodes map[string]*registeredNode
-	store state.Store
+	mu            sync.Mutex
+	nodes         map[string]*registeredNode
+	store         state.Store
+	config        *Config
+	limiter       *registrationLimiter
+	events        *eventBuffer
+	sessionCounts map[string]int
+
+	runCtx     context.Context
+	runCancel  context.CancelFunc
+	running    bool
+	leaderAddr string
+
+	// lastTTLBroadcastNodes is the node count as of the last proactive TTL
+	// rebroadcast, used to detect when the cluster has crossed a
+	// GracePeriodMultiplier boundary.
+	lastTTLBroadcastNodes int
 }
 
-// New returns Dispatcher with store.
-func New(store state.Store) *Dispatcher {
+// New returns Dispatcher with store. A nil config falls back to
+// DefaultConfig.
+func New(store state.Store, config *Config) *Dispatcher {
+	if config == nil {
+		config = DefaultConfig()
+	}
 	return &Dispatcher{
-		nodes: make(map[string]*registeredNode),
-		store: store,
+		nodes:         make(map[string]*registeredNode),
+		store:         store,
+		config:        config,
+		limiter:       newRegistrationLimiter(config.RateLimitBurst, config.RateLimitPeriod),
+		events:        newEventBuffer(defaultEventBufferSize, defaultEventTTL),
+		sessionCounts: make(map[string]int),
+	}
+}
+
+// Run marks the dispatcher active and blocks until ctx is cancelled or Stop
+// is called, at which point it drains all active sessions. It should be
+// called once the local node becomes raft leader, and ctx should be
+// cancelled (or Stop called) as soon as leadership is lost.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return errors.New("dispatcher is already running")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	d.runCtx = runCtx
+	d.runCancel = cancel
+	d.running = true
+	d.mu.Unlock()
+
+	go d.pruneEventsLoop(runCtx)
+
+	<-runCtx.Done()
+	d.mu.Lock()
+	d.running = false
+	d.mu.Unlock()
+	d.drain()
+	return nil
+}
+
+// pruneEventsLoop periodically prunes events older than their TTL from the
+// event buffer, so a quiet dispatcher doesn't hold stale events forever. It
+// exits when ctx (the dispatcher's run context) is done.
+func (d *Dispatcher) pruneEventsLoop(ctx context.Context) {
+	ticker := time.NewTicker(eventPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.events.prune(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop signals Run to return, draining active sessions and redirecting
+// agents to the current leader address, if set, via SetLeaderAddr.
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	if !d.running {
+		d.mu.Unlock()
+		return
+	}
+	d.running = false
+	cancel := d.runCancel
+	d.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// SetLeaderAddr records the address of the current raft leader, so that
+// agents disconnected by a drain can be redirected to it without
+// round-tripping through a discovery layer.
+func (d *Dispatcher) SetLeaderAddr(addr string) {
+	d.mu.Lock()
+	d.leaderAddr = addr
+	d.mu.Unlock()
+}
+
+// isRunningLocked reports whether the dispatcher is currently serving RPCs.
+// Every RPC calls this first so that it fails fast once leadership is lost
+// rather than racing a drain in progress.
+func (d *Dispatcher) isRunningLocked() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.running {
+		return grpc.Errorf(codes.Aborted, "dispatcher is stopped")
+	}
+	return nil
+}
+
+// drain stops every node's heartbeat timer, clears them from the live node
+// index, and closes each node's done channel so any blocked Session or
+// WatchTasks goroutine wakes immediately (in addition to runCtx.Done(),
+// which every such goroutine also selects on) and can notify its agent. It
+// deliberately does not touch
+// the store's Node records: the nodes themselves are not down, only this
+// dispatcher has stopped serving them, so they should reconnect to the new
+// leader and resume from wherever its own view of the store has them.
+// Clearing the index (rather than merely stopping the timers) is what lets
+// registerNode accept these nodes again if this dispatcher later regains
+// leadership and Run is called a second time.
+func (d *Dispatcher) drain() {
+	d.mu.Lock()
+	nodes := d.nodes
+	d.nodes = make(map[string]*registeredNode)
+	d.mu.Unlock()
+
+	for id, n := range nodes {
+		n.Heartbeat.Stop()
+		n.closeDone()
+		d.events.publish(Event{Topic: EventNodeDown, Key: id, Payload: false, At: time.Now()})
 	}
 }
 
 // RegisterNode is used for registration of node with particular dispatcher.
+//
+// Deprecated: agents should use Session instead, which additionally hands
+// back a SessionID required by Heartbeat, UpdateTaskStatus and WatchTasks.
+// RegisterNode is kept for agents that have not yet been upgraded.
 func (d *Dispatcher) RegisterNode(ctx context.Context, r *api.RegisterNodeRequest) (*api.RegisterNodeResponse, error) {
+	if err := d.isRunningLocked(); err != nil {
+		return nil, err
+	}
+	if _, err := d.registerNode(ctx, r.Node); err != nil {
+		if rlErr, ok := err.(*rateLimitedError); ok {
+			grpc.SetTrailer(ctx, metadata.Pairs(retryAfterMetadataKey, rlErr.backoff.String()))
+			return nil, grpc.Errorf(codes.Unavailable, rlErr.Error())
+		}
+		return nil, err
+	}
+	ttl := d.electTTL(r.Node.Id)
+	return &api.RegisterNodeResponse{HeartbeatTTL: uint64(ttl)}, nil
+}
+
+// peerKey extracts a stable identity for the caller of ctx, used to key the
+// registration rate limiter. It falls back to the claimed node ID when no
+// peer information is available (e.g. in tests dialed over an in-process
+// connection).
+func peerKey(ctx context.Context, nodeID string) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return nodeID
+}
+
+// rateLimitedError is returned by registerNode when the caller has been
+// throttled by the registration rate limiter. Callers (RegisterNode,
+// Session) type-assert for it so they can surface backoff as a structured
+// retryAfterMetadataKey trailer instead of leaving the agent to parse it out
+// of the error string.
+type rateLimitedError struct {
+	backoff time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("too many registration attempts, retry after %s", e.backoff)
+}
+
+// registerNode creates or updates the node in the store and installs (or
+// replaces) its entry in d.nodes with a fresh heartbeat. It is shared by
+// RegisterNode and Session.
+func (d *Dispatcher) registerNode(ctx context.Context, n *api.Node) (*registeredNode, error) {
+	if ok, backoff := d.limiter.allow(peerKey(ctx, n.Id)); !ok {
+		return nil, &rateLimitedError{backoff: backoff}
+	}
+
 	d.mu.Lock()
-	_, ok := d.nodes[r.Node.Id]
+	existing, ok := d.nodes[n.Id]
 	d.mu.Unlock()
 	if ok {
-		return nil, grpc.Errorf(codes.AlreadyExists, ErrNodeAlreadyRegistered.Error())
+		// The node may simply be reconnecting after a heartbeat lapse (its
+		// old TCP connection dropped without a graceful
+		// UpdateNodeStatus(DOWN)); rejecting outright would otherwise make
+		// it wait out the old entry's full heartbeat TTL before it could
+		// register again. Stop the stale heartbeat and wake any Session or
+		// WatchTasks goroutine still blocked on the old entry via its done
+		// channel, so a stale in-flight stream is told it has been
+		// superseded instead of lingering until its transport notices.
+		existing.Heartbeat.Stop()
+		existing.closeDone()
 	}
-	n := r.Node
+
+	// A node that reconnects after a heartbeat lapse gets a brand new
+	// registeredNode, but its DRAIN/PAUSE availability (set via
+	// UpdateNodeAvailability) lives in the store and must carry forward
+	// rather than being clobbered by the zero-valued Spec on the
+	// reconnecting agent's Node message.
+	if cur, err := d.store.GetNode(n.Id); err == nil && cur != nil {
+		n.Spec = cur.Spec
+	}
+
 	n.Status = api.NodeStatus_READY
 	// create or update node in raft
-	err := d.store.CreateNode(n.Id, n)
-	if err != nil {
+	if err := d.store.CreateNode(n.Id, n); err != nil {
 		if err != state.ErrExist {
 			return nil, err
 		}
@@ -68,63 +359,495 @@ func (d *Dispatcher) RegisterNode(ctx context.Context, r *api.RegisterNodeReques
 			return nil, err
 		}
 	}
-	ttl := d.electTTL()
+
+	ttl := d.electTTL(n.Id)
+	rn := &registeredNode{
+		Node:  n,
+		Tasks: make(map[string]*api.Task),
+		done:  make(chan struct{}),
+	}
+	rn.Heartbeat = heartbeat.New(ttl, func() {
+		if err := d.nodeDown(n.Id, false); err != nil {
+			logrus.Errorf("error deregistering node %s after heartbeat was not received: %v", n.Id, err)
+		}
+	})
+
 	d.mu.Lock()
-	d.nodes[n.Id] = &registeredNode{
-		Heartbeat: heartbeat.New(ttl, func() {
-			if err := d.nodeDown(n.Id); err != nil {
-				logrus.Errorf("error deregistering node %s after heartbeat was not received: %v", n.Id, err)
-			}
-		}),
-		Node: n,
+	d.nodes[n.Id] = rn
+	d.mu.Unlock()
+	d.maybeRebroadcastTTL()
+	d.events.publish(Event{Topic: EventNodeRegistered, Key: n.Id, At: time.Now()})
+	return rn, nil
+}
+
+// newSession issues a fresh SessionID for node, so any RPC still holding the
+// previous SessionID is rejected by GetWithSession.
+func (d *Dispatcher) newSession(n *registeredNode) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n.SessionID = newSessionID()
+	return n.SessionID
+}
+
+// newSessionID returns a random session token. It is not derived from the
+// node ID so that a restarted agent cannot accidentally reuse a session
+// still held open by the dispatcher.
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// acquireSessionSlot reserves one of Config.MaxConnectionsPerNode
+// concurrently open Session streams for nodeID, returning false if the node
+// is already at its configured maximum. Unlike the replace-on-reconnect
+// logic in registerNode, this bounds truly concurrent Session calls for the
+// same node ID (e.g. two agent processes racing to claim it), which a
+// sequential "stop the old heartbeat and replace" can't catch. The caller
+// must call releaseSessionSlot when the session ends.
+func (d *Dispatcher) acquireSessionSlot(nodeID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	max := d.config.MaxConnectionsPerNode
+	if max <= 0 {
+		max = 1
+	}
+	if d.sessionCounts[nodeID] >= max {
+		return false
+	}
+	d.sessionCounts[nodeID]++
+	return true
+}
+
+// releaseSessionSlot returns the slot reserved by acquireSessionSlot.
+func (d *Dispatcher) releaseSessionSlot(nodeID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessionCounts[nodeID] > 0 {
+		d.sessionCounts[nodeID]--
+	}
+}
+
+// GetWithSession returns the registered node for nodeID if and only if
+// sessionID matches the node's current session. RPCs that require a live
+// session (Heartbeat, UpdateTaskStatus, WatchTasks) use this instead of a
+// plain map lookup so a stale agent connection cannot race a newer one.
+func (d *Dispatcher) GetWithSession(nodeID, sessionID string) (*registeredNode, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	node, ok := d.nodes[nodeID]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, ErrNodeNotRegistered.Error())
+	}
+	if node.SessionID != sessionID {
+		return nil, grpc.Errorf(codes.Aborted, ErrSessionInvalid.Error())
+	}
+	return node, nil
+}
+
+// Session is a long-lived streaming RPC used by agents to register with the
+// dispatcher and keep a channel open for the lifetime of the connection. It
+// replaces the one-shot RegisterNode/polling model: on open the dispatcher
+// creates or updates the node's store record, issues a new SessionID, and
+// acknowledges with a message carrying that SessionID. The acknowledgement
+// does not include the manager set or CA roots. Heartbeat,
+// UpdateTaskStatus and WatchTasks all require this SessionID.
+func (d *Dispatcher) Session(r *api.SessionRequest, stream api.Dispatcher_SessionServer) error {
+	if err := d.isRunningLocked(); err != nil {
+		return err
+	}
+	if !d.acquireSessionSlot(r.NodeID) {
+		return grpc.Errorf(codes.Unavailable, "node %s already has the maximum number of concurrent sessions open", r.NodeID)
 	}
+	defer d.releaseSessionSlot(r.NodeID)
+
+	node := &api.Node{
+		Id:          r.NodeID,
+		Description: r.Description,
+	}
+	rn, err := d.registerNode(stream.Context(), node)
+	if err != nil {
+		if rlErr, ok := err.(*rateLimitedError); ok {
+			stream.SetTrailer(metadata.Pairs(retryAfterMetadataKey, rlErr.backoff.String()))
+			return grpc.Errorf(codes.Unavailable, rlErr.Error())
+		}
+		return err
+	}
+
+	sessionID := d.newSession(rn)
+	if err := stream.Send(&api.SessionMessage{
+		SessionID: sessionID,
+	}); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	runCtx := d.runCtx
 	d.mu.Unlock()
-	return &api.RegisterNodeResponse{HeartbeatTTL: uint64(ttl)}, nil
+	nodeDown := d.nodeDownCh(r.NodeID)
+
+	select {
+	case <-runCtx.Done():
+		// Leadership was lost (or the dispatcher was otherwise stopped).
+		// Give the agent the current leader address, if known, so it can
+		// reconnect without re-discovering the cluster.
+		d.mu.Lock()
+		redirect := d.leaderAddr
+		d.mu.Unlock()
+		_ = stream.Send(&api.SessionMessage{
+			SessionID: sessionID,
+			Redirect:  redirect,
+		})
+		return grpc.Errorf(codes.Aborted, "dispatcher is stopped")
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	case <-nodeDown:
+		return grpc.Errorf(codes.Aborted, "node %s is no longer registered", r.NodeID)
+	}
 }
 
-// UpdateNodeStatus updates status of particular node. Nodes can use it
-// for notifying about graceful shutdowns for example.
-func (d *Dispatcher) UpdateNodeStatus(context.Context, *api.UpdateNodeStatusRequest) (*api.UpdateNodeStatusResponse, error) {
-	return nil, nil
+// UpdateNodeStatus updates status of particular node. Nodes use it for
+// notifying the dispatcher about graceful shutdowns, so the node can be
+// deregistered without logging it as an unexpected heartbeat loss.
+func (d *Dispatcher) UpdateNodeStatus(ctx context.Context, r *api.UpdateNodeStatusRequest) (*api.UpdateNodeStatusResponse, error) {
+	if err := d.isRunningLocked(); err != nil {
+		return nil, err
+	}
+	if _, err := d.GetWithSession(r.NodeID, r.SessionID); err != nil {
+		return nil, err
+	}
+
+	if r.Status != nil && r.Status.State == api.NodeStatus_DOWN {
+		if err := d.nodeDown(r.NodeID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return &api.UpdateNodeStatusResponse{}, nil
 }
 
 // UpdateTaskStatus updates status of task. Node should send such updates
-// on every status change of its tasks.
-func (d *Dispatcher) UpdateTaskStatus(context.Context, *api.UpdateTaskStatusRequest) (*api.UpdateTaskStatusResponse, error) {
+// on every status change of its tasks. Requires a valid SessionID.
+func (d *Dispatcher) UpdateTaskStatus(ctx context.Context, r *api.UpdateTaskStatusRequest) (*api.UpdateTaskStatusResponse, error) {
+	if err := d.isRunningLocked(); err != nil {
+		return nil, err
+	}
+	if _, err := d.GetWithSession(r.NodeID, r.SessionID); err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
-// WatchTasks is a stream of tasks for node. It returns full list of tasks
-// which should be runned on node each time.
-func (d *Dispatcher) WatchTasks(*api.WatchTasksRequest, api.Agent_WatchTasksServer) error {
-	return nil
+// WatchTasks is a stream of tasks assignments for a node. On open it sends a
+// complete snapshot of the tasks currently scheduled to the node, and from
+// then on streams incremental diffs as tasks are added to or removed from
+// the node by the store.
+func (d *Dispatcher) WatchTasks(r *api.WatchTasksRequest, stream api.Agent_WatchTasksServer) error {
+	if err := d.isRunningLocked(); err != nil {
+		return err
+	}
+	if r.NodeID == "" {
+		return grpc.Errorf(codes.InvalidArgument, "node ID is required")
+	}
+
+	node, err := d.GetWithSession(r.NodeID, r.SessionID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	var tasks []*api.Task
+	watch, cancelWatch, err := state.ViewAndWatch(d.store, func(tx state.ReadTx) error {
+		var err error
+		tasks, err = tx.Tasks().Find(state.ByNodeID(r.NodeID))
+		return err
+	},
+		state.EventCreateTask{Task: &api.Task{NodeID: r.NodeID}},
+		state.EventUpdateTask{Task: &api.Task{NodeID: r.NodeID}},
+		state.EventDeleteTask{Task: &api.Task{NodeID: r.NodeID}},
+	)
+	if err != nil {
+		return err
+	}
+	defer cancelWatch()
+
+	nodeDown := d.nodeDownCh(r.NodeID)
+
+	known := node.nodeTasks()
+	for _, t := range tasks {
+		known[t.ID] = t
+	}
+
+	if err := stream.Send(&api.AssignmentsMessage{
+		Type:  api.AssignmentsMessage_COMPLETE,
+		Tasks: tasks,
+	}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event := <-watch:
+			var update, remove []*api.Task
+
+			switch v := event.(type) {
+			case state.EventCreateTask:
+				if v.Task.NodeID != r.NodeID {
+					continue
+				}
+				known[v.Task.ID] = v.Task
+				update = append(update, v.Task)
+			case state.EventUpdateTask:
+				if v.Task.NodeID != r.NodeID {
+					continue
+				}
+				known[v.Task.ID] = v.Task
+				update = append(update, v.Task)
+			case state.EventDeleteTask:
+				if v.Task.NodeID != r.NodeID {
+					continue
+				}
+				delete(known, v.Task.ID)
+				remove = append(remove, v.Task)
+			default:
+				continue
+			}
+
+			msg := &api.AssignmentsMessage{
+				Type:        api.AssignmentsMessage_INCREMENTAL,
+				UpdateTasks: update,
+				RemoveTasks: remove,
+			}
+			if err := d.trySend(stream, msg); err != nil {
+				return err
+			}
+			for _, t := range update {
+				d.events.publish(Event{Topic: EventTaskAssigned, Key: t.ID, Payload: r.NodeID, At: time.Now()})
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-nodeDown:
+			return grpc.Errorf(codes.Aborted, "node %s is no longer registered", r.NodeID)
+		case <-d.runCtx.Done():
+			return grpc.Errorf(codes.Aborted, "dispatcher is stopped")
+		}
+	}
+}
+
+// trySend attempts to deliver msg on stream, giving up and returning an
+// error if the stream's send buffer is stalled longer than sendTimeout so a
+// single slow agent cannot block the watch goroutine indefinitely.
+func (d *Dispatcher) trySend(stream api.Agent_WatchTasksServer, msg *api.AssignmentsMessage) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- stream.Send(msg)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(sendTimeout):
+		return grpc.Errorf(codes.DeadlineExceeded, "timed out sending assignments to node")
+	}
+}
+
+// nodeDownCh returns the registeredNode's own done channel, which nodeDown,
+// drain and a superseding registerNode call all close, so in-flight watch
+// streams unblock and exit as soon as it happens rather than only the next
+// time they happen to re-enter their select. If nodeID is already
+// deregistered, it returns a channel that is already closed.
+func (d *Dispatcher) nodeDownCh(nodeID string) <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if rn, ok := d.nodes[nodeID]; ok {
+		return rn.done
+	}
+	ch := make(chan struct{})
+	close(ch)
+	return ch
 }
 
-func (d *Dispatcher) nodeDown(id string) error {
+// nodeDown removes id from the live node index and marks it DOWN in the
+// store. graceful distinguishes an explicit shutdown notification (via
+// UpdateNodeStatus) from a heartbeat lapse: in both cases the node is
+// deregistered the same way, but only the heartbeat-lapse case is logged as
+// unexpected, and in neither case is the node's Spec (and therefore any
+// DRAIN/PAUSE availability) touched, so it is preserved across reconnects.
+func (d *Dispatcher) nodeDown(id string, graceful bool) error {
 	d.mu.Lock()
+	rn, ok := d.nodes[id]
 	delete(d.nodes, id)
 	d.mu.Unlock()
-	if err := d.store.UpdateNode(id, &api.Node{Id: id, Status: api.NodeStatus_DOWN}); err != nil {
+	if ok {
+		rn.Heartbeat.Stop()
+		rn.closeDone()
+	}
+	d.maybeRebroadcastTTL()
+
+	n, err := d.store.GetNode(id)
+	if err != nil {
+		n = &api.Node{Id: id}
+	}
+	n.Status = api.NodeStatus_DOWN
+	if !graceful {
+		logrus.Warnf("node %s heartbeat expired, marking down", id)
+	}
+	if err := d.store.UpdateNode(id, n); err != nil {
 		return fmt.Errorf("failed to update node %s status to down", id)
 	}
+	d.events.publish(Event{Topic: EventNodeDown, Key: id, Payload: graceful, At: time.Now()})
+	return nil
+}
+
+// shouldDrainNode reports whether tasks on a node with the given
+// availability should be migrated off of it. Only an explicit DRAIN
+// triggers migration; PAUSE merely stops new scheduling onto the node.
+func shouldDrainNode(avail api.NodeSpec_Availability) bool {
+	return avail == api.NodeSpec_DRAIN
+}
+
+// UpdateNodeAvailability transitions a node between ACTIVE, PAUSE and DRAIN.
+// Draining a node does not tear down its session: the agent keeps it open
+// to report the shutdown progress of its existing tasks, which are marked
+// SHUTDOWN here so the orchestrator reschedules them elsewhere.
+func (d *Dispatcher) UpdateNodeAvailability(ctx context.Context, r *api.UpdateNodeAvailabilityRequest) (*api.UpdateNodeAvailabilityResponse, error) {
+	if err := d.isRunningLocked(); err != nil {
+		return nil, err
+	}
+
+	n, err := d.store.GetNode(r.NodeID)
+	if err != nil {
+		return nil, grpc.Errorf(codes.NotFound, ErrNodeNotRegistered.Error())
+	}
+	n.Spec.Availability = r.Availability
+	if err := d.store.UpdateNode(r.NodeID, n); err != nil {
+		return nil, err
+	}
+
+	if shouldDrainNode(r.Availability) {
+		if err := d.migrateNodeTasks(r.NodeID); err != nil {
+			return nil, err
+		}
+	}
+
+	return &api.UpdateNodeAvailabilityResponse{}, nil
+}
+
+// migrateNodeTasks marks every task currently assigned to nodeID as
+// SHUTDOWN so the orchestrator reschedules it onto a node that is still
+// accepting work.
+func (d *Dispatcher) migrateNodeTasks(nodeID string) error {
+	var tasks []*api.Task
+	if err := d.store.View(func(tx state.ReadTx) error {
+		var err error
+		tasks, err = tx.Tasks().Find(state.ByNodeID(nodeID))
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		t.DesiredState = api.TaskState_SHUTDOWN
+		if err := d.store.UpdateTask(t.ID, t); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (d *Dispatcher) electTTL() time.Duration {
-	return defaultTTL
+// electTTL computes the heartbeat TTL to hand back to nodeID: it scales
+// with the number of currently registered nodes so that a dispatcher
+// failover, which makes every agent reconnect at once, doesn't also make
+// every agent's heartbeat deadline land in the same instant. A small
+// per-node jitter, stable across calls for the same node, spreads beats out
+// further still.
+func (d *Dispatcher) electTTL(nodeID string) time.Duration {
+	d.mu.Lock()
+	nodes := len(d.nodes)
+	cfg := d.config
+	d.mu.Unlock()
+	return computeHeartbeatTTL(cfg, nodes, nodeID)
+}
+
+// computeHeartbeatTTL implements ttl = clamp(base * (1 +
+// nodes/GracePeriodMultiplier), minHeartbeatTTL, maxHeartbeatTTL) + jitter.
+func computeHeartbeatTTL(cfg *Config, nodes int, nodeID string) time.Duration {
+	base := cfg.HeartbeatPeriod
+	grace := cfg.GracePeriodMultiplier
+	if grace <= 0 {
+		grace = 1
+	}
+	scale := 1 + float64(nodes)/float64(grace)
+	ttl := time.Duration(float64(base) * scale)
+	if ttl < minHeartbeatTTL {
+		ttl = minHeartbeatTTL
+	}
+	if ttl > maxHeartbeatTTL {
+		ttl = maxHeartbeatTTL
+	}
+	return ttl + jitter(cfg.HeartbeatEpsilon, nodeID)
+}
+
+// jitter returns a deterministic offset in [0, epsilon) derived from
+// nodeID. It is deterministic, rather than random, so that a node's TTL
+// doesn't bounce around between successive heartbeats of an otherwise
+// unchanged cluster, while still differing from its neighbors' TTLs.
+//
+// epsilon is a time.Duration, i.e. a count of nanoseconds, so it routinely
+// exceeds the range of a uint32 (about 4.29s); hashing and reducing in
+// 64-bit avoids silently wrapping the modulus for any epsilon above that.
+func jitter(epsilon time.Duration, nodeID string) time.Duration {
+	if epsilon <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeID))
+	return time.Duration(h.Sum64() % uint64(epsilon))
+}
+
+// maybeRebroadcastTTL recomputes the heartbeat TTL for every registered node
+// and pushes it to their local heartbeat timers whenever the cluster size
+// crosses a GracePeriodMultiplier boundary, rather than waiting for each
+// node's next Heartbeat call to pick up the change.
+func (d *Dispatcher) maybeRebroadcastTTL() {
+	d.mu.Lock()
+	grace := d.config.GracePeriodMultiplier
+	if grace <= 0 {
+		d.mu.Unlock()
+		return
+	}
+	nodes := len(d.nodes)
+	if nodes/grace == d.lastTTLBroadcastNodes/grace {
+		d.mu.Unlock()
+		return
+	}
+	d.lastTTLBroadcastNodes = nodes
+	cfg := d.config
+	rns := make([]*registeredNode, 0, len(d.nodes))
+	for _, rn := range d.nodes {
+		rns = append(rns, rn)
+	}
+	d.mu.Unlock()
+
+	for _, rn := range rns {
+		rn.Heartbeat.Update(computeHeartbeatTTL(cfg, nodes, rn.Node.Id))
+	}
 }
 
 // Heartbeat is heartbeat method for nodes. It returns new TTL in response.
 // Node should send new heartbeat earlier than now + TTL, otherwise it will
 // be deregistered from dispatcher and its status will be updated to NodeStatus_DOWN
 func (d *Dispatcher) Heartbeat(ctx context.Context, r *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
-	d.mu.Lock()
-	node, ok := d.nodes[r.NodeID]
-	d.mu.Unlock()
-	if !ok {
-		return nil, grpc.Errorf(codes.NotFound, ErrNodeNotRegistered.Error())
+	if err := d.isRunningLocked(); err != nil {
+		return nil, err
+	}
+	node, err := d.GetWithSession(r.NodeID, r.SessionID)
+	if err != nil {
+		return nil, err
 	}
-	ttl := d.electTTL()
+	ttl := d.electTTL(r.NodeID)
 	node.Heartbeat.Update(ttl)
 	node.Heartbeat.Beat()
 	return &api.HeartbeatResponse{HeartbeatTTL: uint64(ttl)}, nil
@@ -0,0 +1,215 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/swarm-v2/api"
+	"github.com/docker/swarm-v2/pkg/heartbeat"
+	"golang.org/x/net/context"
+)
+
+func TestComputeHeartbeatTTLClampsToMin(t *testing.T) {
+	cfg := &Config{HeartbeatPeriod: time.Millisecond, GracePeriodMultiplier: 50}
+	ttl := computeHeartbeatTTL(cfg, 0, "node-1")
+	if ttl < minHeartbeatTTL {
+		t.Fatalf("expected ttl to be clamped to at least minHeartbeatTTL (%s), got %s", minHeartbeatTTL, ttl)
+	}
+}
+
+func TestComputeHeartbeatTTLClampsToMax(t *testing.T) {
+	cfg := &Config{HeartbeatPeriod: time.Hour, GracePeriodMultiplier: 50}
+	ttl := computeHeartbeatTTL(cfg, 100000, "node-1")
+	if ttl > maxHeartbeatTTL+time.Hour {
+		t.Fatalf("expected ttl to be clamped near maxHeartbeatTTL (%s), got %s", maxHeartbeatTTL, ttl)
+	}
+	if ttl < maxHeartbeatTTL {
+		t.Fatalf("expected scaled ttl to reach maxHeartbeatTTL (%s), got %s", maxHeartbeatTTL, ttl)
+	}
+}
+
+func TestComputeHeartbeatTTLScalesWithClusterSize(t *testing.T) {
+	cfg := &Config{HeartbeatPeriod: time.Second, GracePeriodMultiplier: 50, HeartbeatEpsilon: 0}
+	small := computeHeartbeatTTL(cfg, 0, "node-1")
+	large := computeHeartbeatTTL(cfg, 50, "node-1")
+	if large <= small {
+		t.Fatalf("expected ttl to grow with cluster size: small=%s large=%s", small, large)
+	}
+}
+
+func TestJitterDoesNotTruncateForLargeEpsilon(t *testing.T) {
+	// epsilon exceeds the ~4.29s range of a uint32 count of nanoseconds;
+	// a truncating implementation would reduce modulo a wrapped value
+	// instead of the full 5s range.
+	epsilon := 5 * time.Second
+	j := jitter(epsilon, "some-node-id")
+	if j < 0 || j >= epsilon {
+		t.Fatalf("expected jitter in [0, %s), got %s", epsilon, j)
+	}
+	// FNV-64a of "some-node-id" modulo 5s is about 4.68s, beyond the
+	// ~705ms that a modulus wrapped to uint32 could ever produce.
+	if wrapped := time.Duration(uint32(epsilon)); j < wrapped {
+		t.Fatalf("expected jitter beyond the wrapped uint32 range (%s), got %s", wrapped, j)
+	}
+}
+
+func TestJitterIsDeterministicPerNode(t *testing.T) {
+	epsilon := 5 * time.Second
+	a := jitter(epsilon, "node-1")
+	b := jitter(epsilon, "node-1")
+	if a != b {
+		t.Fatalf("expected jitter to be stable across calls for the same node, got %s and %s", a, b)
+	}
+}
+
+func TestJitterZeroEpsilon(t *testing.T) {
+	if j := jitter(0, "node-1"); j != 0 {
+		t.Fatalf("expected zero jitter for zero epsilon, got %s", j)
+	}
+}
+
+func TestGetWithSessionRejectsStaleSession(t *testing.T) {
+	d := &Dispatcher{nodes: map[string]*registeredNode{
+		"node-1": {SessionID: "current-session"},
+	}}
+
+	if _, err := d.GetWithSession("node-1", "stale-session"); err == nil {
+		t.Fatal("expected an error for a stale SessionID")
+	}
+	if _, err := d.GetWithSession("node-1", "current-session"); err != nil {
+		t.Fatalf("expected the current SessionID to be accepted, got %v", err)
+	}
+}
+
+func TestGetWithSessionRejectsUnknownNode(t *testing.T) {
+	d := &Dispatcher{nodes: map[string]*registeredNode{}}
+	if _, err := d.GetWithSession("missing-node", "any-session"); err == nil {
+		t.Fatal("expected an error for a node that was never registered")
+	}
+}
+
+func TestAcquireSessionSlotEnforcesMax(t *testing.T) {
+	d := &Dispatcher{
+		config:        &Config{MaxConnectionsPerNode: 2},
+		sessionCounts: make(map[string]int),
+	}
+
+	if !d.acquireSessionSlot("node-1") {
+		t.Fatal("expected the first slot to be available")
+	}
+	if !d.acquireSessionSlot("node-1") {
+		t.Fatal("expected the second slot to be available")
+	}
+	if d.acquireSessionSlot("node-1") {
+		t.Fatal("expected the third acquire to be rejected once MaxConnectionsPerNode is reached")
+	}
+
+	d.releaseSessionSlot("node-1")
+	if !d.acquireSessionSlot("node-1") {
+		t.Fatal("expected a slot to be available again after release")
+	}
+}
+
+func TestAcquireSessionSlotDefaultsToOne(t *testing.T) {
+	d := &Dispatcher{
+		config:        &Config{},
+		sessionCounts: make(map[string]int),
+	}
+
+	if !d.acquireSessionSlot("node-1") {
+		t.Fatal("expected the first slot to be available")
+	}
+	if d.acquireSessionSlot("node-1") {
+		t.Fatal("expected MaxConnectionsPerNode <= 0 to default to a single concurrent session")
+	}
+}
+
+func TestShouldDrainNode(t *testing.T) {
+	if shouldDrainNode(api.NodeSpec_ACTIVE) {
+		t.Fatal("ACTIVE should not trigger task migration")
+	}
+	if shouldDrainNode(api.NodeSpec_PAUSE) {
+		t.Fatal("PAUSE should not trigger task migration")
+	}
+	if !shouldDrainNode(api.NodeSpec_DRAIN) {
+		t.Fatal("DRAIN should trigger task migration")
+	}
+}
+
+func TestRunStopGatesIsRunningLocked(t *testing.T) {
+	d := New(nil, nil)
+
+	if err := d.isRunningLocked(); err == nil {
+		t.Fatal("expected isRunningLocked to fail before Run is called")
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- d.Run(context.Background()) }()
+
+	for i := 0; d.isRunningLocked() != nil; i++ {
+		if i > 1000 {
+			t.Fatal("Run never marked the dispatcher as running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.Stop()
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatalf("expected Run to return nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	if err := d.isRunningLocked(); err == nil {
+		t.Fatal("expected isRunningLocked to fail again after Stop")
+	}
+}
+
+// nodeDownChWaker blocks on nodeDownCh the same way Session and WatchTasks
+// do, so this test exercises the exact regression the review called out: a
+// call blocked with no other events in flight must still return as soon as
+// the node goes down, not hang until some unrelated event re-enters its
+// select.
+func nodeDownChWaker(d *Dispatcher, nodeID string, done chan<- struct{}) {
+	<-d.nodeDownCh(nodeID)
+	close(done)
+}
+
+func TestDrainClosesDoneAndWakesBlockedWaiters(t *testing.T) {
+	d := New(nil, nil)
+	rn := &registeredNode{
+		Heartbeat: heartbeat.New(time.Hour, func() {}),
+		done:      make(chan struct{}),
+	}
+	d.nodes["node-1"] = rn
+
+	woken := make(chan struct{})
+	go nodeDownChWaker(d, "node-1", woken)
+
+	d.drain()
+
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatal("blocked waiter was not woken by drain")
+	}
+
+	if len(d.nodes) != 0 {
+		t.Fatalf("expected drain to clear the live node index, got %d entries", len(d.nodes))
+	}
+}
+
+func TestCloseDoneIsSafeToCallTwice(t *testing.T) {
+	rn := &registeredNode{done: make(chan struct{})}
+	rn.closeDone()
+	rn.closeDone()
+	select {
+	case <-rn.done:
+	default:
+		t.Fatal("expected done to be closed")
+	}
+}
@@ -0,0 +1,190 @@
+package dispatcher
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// EventTopic identifies the kind of event published on the dispatcher's
+// event bus.
+type EventTopic string
+
+const (
+	// EventNodeRegistered fires whenever a node completes registration,
+	// via either RegisterNode or Session.
+	EventNodeRegistered EventTopic = "NodeRegistered"
+	// EventNodeDown fires whenever a node is deregistered, whether due to
+	// a missed heartbeat or a graceful shutdown notification.
+	EventNodeDown EventTopic = "NodeDown"
+	// EventTaskAssigned fires whenever a task is added to or updated on a
+	// node's assignment set during WatchTasks.
+	EventTaskAssigned EventTopic = "TaskAssigned"
+)
+
+// Event is a single item published to the dispatcher's event bus.
+type Event struct {
+	Topic   EventTopic
+	Key     string // typically the node or task ID the event concerns
+	Payload interface{}
+	At      time.Time
+}
+
+// ErrSubscriptionClosed is returned by subscription.Next when the
+// subscriber has fallen behind far enough that the next event it was
+// waiting for has already been pruned from the buffer. The caller should
+// treat this like a lost connection and re-subscribe (picking up a fresh
+// snapshot through whatever means applies, e.g. a new WatchTasks COMPLETE
+// message) rather than retry the same subscription.
+var ErrSubscriptionClosed = errors.New("subscription closed: fell behind event buffer")
+
+const (
+	defaultEventBufferSize = 1024
+	defaultEventTTL        = 5 * time.Minute
+	eventPruneInterval     = 30 * time.Second
+)
+
+type bufferedEvent struct {
+	event Event
+	index uint64
+}
+
+// eventBuffer is a fixed-capacity ring buffer of published events. Each
+// event is assigned a monotonically increasing absolute index; subscribers
+// track the next index they have not yet consumed, so a slow subscriber
+// falls behind the buffer rather than blocking publishers. Items are
+// additionally pruned once older than ttl, independent of whether the
+// buffer is at capacity, so a quiet dispatcher doesn't hold stale events
+// indefinitely.
+type eventBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	items    []bufferedEvent
+	capacity int
+	ttl      time.Duration
+
+	// nextIndex is the index that will be assigned to the next published
+	// event. oldestIndex is the index of the oldest item still retained;
+	// items before it have been evicted by capacity or TTL pruning.
+	nextIndex   uint64
+	oldestIndex uint64
+}
+
+func newEventBuffer(capacity int, ttl time.Duration) *eventBuffer {
+	b := &eventBuffer{
+		items:    make([]bufferedEvent, capacity),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// publish appends event to the buffer, evicting the oldest item once the
+// buffer is at capacity, and wakes any subscriber blocked in Next.
+func (b *eventBuffer) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := b.nextIndex
+	b.items[idx%uint64(b.capacity)] = bufferedEvent{event: ev, index: idx}
+	b.nextIndex++
+	if b.nextIndex-b.oldestIndex > uint64(b.capacity) {
+		b.oldestIndex = b.nextIndex - uint64(b.capacity)
+	}
+	b.cond.Broadcast()
+}
+
+// prune advances oldestIndex past any items older than ttl. It is called
+// periodically by the dispatcher's background pruner goroutine.
+func (b *eventBuffer) prune(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.oldestIndex < b.nextIndex {
+		item := b.items[b.oldestIndex%uint64(b.capacity)]
+		if now.Sub(item.event.At) <= b.ttl {
+			break
+		}
+		b.oldestIndex++
+	}
+}
+
+// subscription is one subscriber's view into a dispatcher's event buffer.
+// It tracks the next absolute index it has not yet delivered, and an
+// optional topic filter.
+type subscription struct {
+	buffer *eventBuffer
+	topics map[EventTopic]bool // nil matches every topic
+	next   uint64
+}
+
+// Subscribe registers a new subscription over topics (all topics if none
+// are given), starting from events published from this point on. Internal
+// components (metrics, audit log, task reaper) can call this directly; a
+// future WatchEvents RPC can expose the same mechanism to external
+// consumers.
+func (d *Dispatcher) Subscribe(topics ...EventTopic) *subscription {
+	d.events.mu.Lock()
+	next := d.events.nextIndex
+	d.events.mu.Unlock()
+
+	var filter map[EventTopic]bool
+	if len(topics) > 0 {
+		filter = make(map[EventTopic]bool, len(topics))
+		for _, t := range topics {
+			filter[t] = true
+		}
+	}
+	return &subscription{
+		buffer: d.events,
+		topics: filter,
+		next:   next,
+	}
+}
+
+// Next blocks until an event matching the subscription's topic filter is
+// published, ctx is done, or the subscription has fallen behind the
+// buffer's retention window (in which case it returns
+// ErrSubscriptionClosed rather than blocking the publisher that evicted the
+// event it needed).
+func (s *subscription) Next(ctx context.Context) (Event, error) {
+	b := s.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if s.next < b.oldestIndex {
+			return Event{}, ErrSubscriptionClosed
+		}
+		if s.next < b.nextIndex {
+			item := b.items[s.next%uint64(b.capacity)]
+			s.next++
+			if s.topics == nil || s.topics[item.event.Topic] {
+				return item.event, nil
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return Event{}, ctx.Err()
+		}
+
+		// sync.Cond has no cancellable wait, so spawn a one-shot
+		// goroutine that broadcasts on ctx cancellation to wake us up
+		// for the ctx.Err() check above.
+		woken := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.mu.Lock()
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			case <-woken:
+			}
+		}()
+		b.cond.Wait()
+		close(woken)
+	}
+}
@@ -0,0 +1,93 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEventBufferPublishAndSubscribe(t *testing.T) {
+	d := &Dispatcher{events: newEventBuffer(4, time.Hour)}
+	sub := d.Subscribe()
+
+	d.events.publish(Event{Topic: EventNodeRegistered, Key: "node-1", At: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ev, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ev.Topic != EventNodeRegistered || ev.Key != "node-1" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestEventBufferFiltersByTopic(t *testing.T) {
+	d := &Dispatcher{events: newEventBuffer(4, time.Hour)}
+	sub := d.Subscribe(EventTaskAssigned)
+
+	d.events.publish(Event{Topic: EventNodeRegistered, Key: "node-1", At: time.Now()})
+	d.events.publish(Event{Topic: EventTaskAssigned, Key: "task-1", At: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ev, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ev.Topic != EventTaskAssigned {
+		t.Fatalf("expected filter to skip EventNodeRegistered, got %+v", ev)
+	}
+}
+
+func TestEventBufferNextReturnsOnContextCancel(t *testing.T) {
+	b := newEventBuffer(4, time.Hour)
+	sub := &subscription{buffer: b, next: b.nextIndex}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := sub.Next(ctx)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return after context cancellation")
+	}
+}
+
+func TestEventBufferEvictionClosesSlowSubscriber(t *testing.T) {
+	b := newEventBuffer(2, time.Hour)
+	sub := &subscription{buffer: b, next: b.nextIndex}
+
+	// Publish more events than the buffer can retain without the
+	// subscriber ever reading, so its next index falls behind oldestIndex.
+	for i := 0; i < 5; i++ {
+		b.publish(Event{Topic: EventNodeRegistered, Key: "node", At: time.Now()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := sub.Next(ctx); err != ErrSubscriptionClosed {
+		t.Fatalf("expected ErrSubscriptionClosed for a subscriber behind the retention window, got %v", err)
+	}
+}
+
+func TestEventBufferPruneEvictsExpiredItems(t *testing.T) {
+	b := newEventBuffer(4, time.Millisecond)
+	b.publish(Event{Topic: EventNodeRegistered, Key: "node", At: time.Now().Add(-time.Hour)})
+
+	b.prune(time.Now())
+
+	if b.oldestIndex != b.nextIndex {
+		t.Fatalf("expected prune to evict the expired item, oldestIndex=%d nextIndex=%d", b.oldestIndex, b.nextIndex)
+	}
+}
@@ -0,0 +1,101 @@
+package dispatcher
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxLimiterEntries bounds the number of distinct peers the limiter
+	// tracks at once; the least recently seen entry is evicted once the
+	// bound is exceeded so a flood of distinct addresses cannot grow the
+	// limiter state unboundedly.
+	maxLimiterEntries = 4096
+
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// registrationLimiter throttles RegisterNode/Session attempts per peer
+// identity (the dialed address, falling back to the claimed node ID) so a
+// crash-looping or misbehaving agent cannot hammer the raft store with
+// CreateNode/UpdateNode storms, for example when thousands of agents
+// reconnect simultaneously after a dispatcher restart.
+type registrationLimiter struct {
+	mu     sync.Mutex
+	burst  int
+	period time.Duration
+
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type limiterEntry struct {
+	key         string
+	limiter     *rate.Limiter
+	prevBackoff time.Duration
+}
+
+// newRegistrationLimiter returns a limiter allowing burst attempts per
+// period for each distinct peer.
+func newRegistrationLimiter(burst int, period time.Duration) *registrationLimiter {
+	return &registrationLimiter{
+		burst:   burst,
+		period:  period,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// allow reports whether the caller identified by key may proceed. When it
+// returns false, backoff is how long the dispatcher should advise the peer
+// to wait before retrying, computed as initial + 2*prev (clamped to
+// maxBackoff) so repeated rejections grow the hint exponentially, mirroring
+// the agent-side backoff growth used by the session loop.
+func (l *registrationLimiter) allow(key string) (ok bool, backoff time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, found := l.entries[key]
+	var e *limiterEntry
+	if found {
+		e = el.Value.(*limiterEntry)
+		l.order.MoveToFront(el)
+	} else {
+		every := l.period
+		if l.burst > 0 {
+			every = l.period / time.Duration(l.burst)
+		}
+		e = &limiterEntry{key: key, limiter: rate.NewLimiter(rate.Every(every), l.burst)}
+		l.entries[key] = l.order.PushFront(e)
+		l.evictLocked()
+	}
+
+	if e.limiter.Allow() {
+		e.prevBackoff = 0
+		return true, 0
+	}
+
+	backoff = initialBackoff + 2*e.prevBackoff
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	e.prevBackoff = backoff
+	return false, backoff
+}
+
+// evictLocked drops the least recently used entries once the limiter holds
+// more than maxLimiterEntries. l.mu must be held.
+func (l *registrationLimiter) evictLocked() {
+	for len(l.entries) > maxLimiterEntries {
+		oldest := l.order.Back()
+		if oldest == nil {
+			return
+		}
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*limiterEntry).key)
+	}
+}
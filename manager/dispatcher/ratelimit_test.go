@@ -0,0 +1,67 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistrationLimiterAllowsBurst(t *testing.T) {
+	l := newRegistrationLimiter(3, time.Second)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("peer-a"); !ok {
+			t.Fatalf("attempt %d: expected allow within burst", i)
+		}
+	}
+	ok, backoff := l.allow("peer-a")
+	if ok {
+		t.Fatal("expected the 4th attempt within the period to be throttled")
+	}
+	if backoff != initialBackoff {
+		t.Fatalf("expected first backoff to be initialBackoff (%s), got %s", initialBackoff, backoff)
+	}
+}
+
+func TestRegistrationLimiterBackoffGrowsAndClamps(t *testing.T) {
+	l := newRegistrationLimiter(1, time.Hour)
+	if ok, _ := l.allow("peer-a"); !ok {
+		t.Fatal("expected the first attempt to be allowed")
+	}
+
+	var last time.Duration
+	for i := 0; i < 10; i++ {
+		ok, backoff := l.allow("peer-a")
+		if ok {
+			t.Fatalf("attempt %d: expected throttling with a 1-hour period", i)
+		}
+		if backoff < last {
+			t.Fatalf("attempt %d: backoff shrank from %s to %s", i, last, backoff)
+		}
+		if backoff > maxBackoff {
+			t.Fatalf("attempt %d: backoff %s exceeds maxBackoff %s", i, backoff, maxBackoff)
+		}
+		last = backoff
+	}
+	if last != maxBackoff {
+		t.Fatalf("expected repeated throttling to clamp at maxBackoff (%s), got %s", maxBackoff, last)
+	}
+}
+
+func TestRegistrationLimiterTracksPeersIndependently(t *testing.T) {
+	l := newRegistrationLimiter(1, time.Hour)
+	if ok, _ := l.allow("peer-a"); !ok {
+		t.Fatal("expected peer-a's first attempt to be allowed")
+	}
+	if ok, _ := l.allow("peer-b"); !ok {
+		t.Fatal("peer-b should not be throttled by peer-a's attempts")
+	}
+}
+
+func TestRegistrationLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newRegistrationLimiter(1, time.Hour)
+	for i := 0; i < maxLimiterEntries+10; i++ {
+		l.allow(string(rune(i)))
+	}
+	if len(l.entries) > maxLimiterEntries {
+		t.Fatalf("expected at most %d entries, got %d", maxLimiterEntries, len(l.entries))
+	}
+}